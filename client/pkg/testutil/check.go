@@ -0,0 +1,135 @@
+// Copyright 2023 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkDefaultDeadline is how long Check polls for goroutines that were
+// not in its baseline to exit before it reports them as leaked.
+const checkDefaultDeadline = 5 * time.Second
+
+// goroutineHeaderRegexp matches the header line of a single goroutine's
+// entry in a runtime.Stack dump, e.g. "goroutine 42 [chan receive]:".
+var goroutineHeaderRegexp = regexp.MustCompile(`^goroutine (\d+) \[`)
+
+// Check snapshots the IDs of all goroutines running when it is called
+// and returns a closure that fails t if, after polling with exponential
+// backoff for up to deadline (5s if unspecified), any goroutine outside
+// that baseline is still running. Unlike CheckAfterTest's hardcoded
+// badSubstring list, Check never flags a goroutine that was already
+// running before the test started, so it composes cleanly with TestMain
+// setup that leaves long-lived shared goroutines behind.
+//
+// Check also registers the closure with t.Cleanup, so a single
+//
+//	defer testutil.Check(t)()
+//
+// at the top of a test is enough: the explicit defer reports the leak as
+// soon as the test body returns, and the Cleanup registration is a
+// backstop for callers who drop the returned closure.
+func Check(t TB, deadline ...time.Duration) func() {
+	d := checkDefaultDeadline
+	if len(deadline) > 0 {
+		d = deadline[0]
+	}
+	baseline := goroutineIDSet()
+
+	var once sync.Once
+	check := func() {
+		once.Do(func() {
+			if leaked := waitForGoroutines(baseline, d); len(leaked) > 0 {
+				t.Errorf("Test %v appears to have leaked goroutine(s):\n%s", t.Name(), strings.Join(leaked, "\n\n"))
+			}
+		})
+	}
+	t.Cleanup(check)
+	return check
+}
+
+// goroutineIDSet returns the IDs of all goroutines currently running.
+func goroutineIDSet() map[uint64]bool {
+	ids := make(map[uint64]bool)
+	for _, g := range strings.Split(stackDump(), "\n\n") {
+		if id, ok := parseGoroutineID(g); ok {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// parseGoroutineID extracts the goroutine ID from the header line of a
+// single goroutine's dump, e.g. "goroutine 42 [chan receive]:\n\t...".
+func parseGoroutineID(dump string) (uint64, bool) {
+	header := strings.SplitN(dump, "\n", 2)[0]
+	m := goroutineHeaderRegexp.FindStringSubmatch(header)
+	if m == nil {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(m[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// waitForGoroutines polls, with exponential backoff, for every goroutine
+// outside baseline to exit, for up to deadline. It returns the stacks
+// (sorted by goroutine ID) of any that are still running when the
+// deadline is reached.
+func waitForGoroutines(baseline map[uint64]bool, deadline time.Duration) []string {
+	start := time.Now()
+	backoff := time.Millisecond
+	for {
+		leaked := leakedGoroutines(baseline)
+		if len(leaked) == 0 || time.Since(start) >= deadline {
+			return leaked
+		}
+		time.Sleep(backoff)
+		if backoff < 100*time.Millisecond {
+			backoff *= 2
+		}
+	}
+}
+
+// leakedGoroutines returns the stacks, sorted by goroutine ID, of every
+// currently running goroutine whose ID is not in baseline.
+func leakedGoroutines(baseline map[uint64]bool) []string {
+	type leak struct {
+		id    uint64
+		stack string
+	}
+	var leaks []leak
+	for _, g := range strings.Split(stackDump(), "\n\n") {
+		id, ok := parseGoroutineID(g)
+		if !ok || baseline[id] {
+			continue
+		}
+		leaks = append(leaks, leak{id, strings.TrimSpace(g)})
+	}
+	sort.Slice(leaks, func(i, j int) bool { return leaks[i].id < leaks[j].id })
+
+	stacks := make([]string, 0, len(leaks))
+	for _, l := range leaks {
+		stacks = append(stacks, l.stack)
+	}
+	return stacks
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import "testing"
+
+func TestParseGoroutineID(t *testing.T) {
+	tests := []struct {
+		name   string
+		dump   string
+		wantID uint64
+		wantOK bool
+	}{
+		{
+			name:   "running",
+			dump:   "goroutine 1 [running]:\nmain.main()\n\t/tmp/main.go:5 +0x20",
+			wantID: 1,
+			wantOK: true,
+		},
+		{
+			name:   "waiting with minutes",
+			dump:   "goroutine 7 [chan receive, 10 minutes]:\nmain.f()\n\t/tmp/main.go:9",
+			wantID: 7,
+			wantOK: true,
+		},
+		{
+			name:   "locked to thread",
+			dump:   "goroutine 8 [syscall, locked to thread]:\nmain.g()\n\t/tmp/main.go:12",
+			wantID: 8,
+			wantOK: true,
+		},
+		{
+			name:   "minutes and locked to thread",
+			dump:   "goroutine 9 [chan receive, 10 minutes, locked to thread]:\nmain.h()\n\t/tmp/main.go:15",
+			wantID: 9,
+			wantOK: true,
+		},
+		{
+			name:   "not a goroutine header",
+			dump:   "not a goroutine dump at all",
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := parseGoroutineID(tt.dump)
+			if ok != tt.wantOK {
+				t.Fatalf("parseGoroutineID(%q) ok = %v, want %v", tt.dump, ok, tt.wantOK)
+			}
+			if ok && id != tt.wantID {
+				t.Errorf("parseGoroutineID(%q) id = %d, want %d", tt.dump, id, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestWaitForGoroutinesIgnoresBaseline(t *testing.T) {
+	baseline := goroutineIDSet()
+	if leaked := waitForGoroutines(baseline, 0); len(leaked) != 0 {
+		t.Errorf("waitForGoroutines against its own baseline should report no leaks, got %d", len(leaked))
+	}
+}
+
+func TestWaitForGoroutinesDetectsNew(t *testing.T) {
+	baseline := goroutineIDSet()
+
+	done := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		close(started)
+		<-done
+	}()
+	defer close(done)
+	<-started
+
+	if leaked := waitForGoroutines(baseline, 0); len(leaked) == 0 {
+		t.Errorf("expected the goroutine started after the baseline was taken to be reported as leaked")
+	}
+}
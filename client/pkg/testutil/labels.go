@@ -0,0 +1,73 @@
+// Copyright 2023 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"context"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+)
+
+// goroutineLabels records the labels WithGoroutineLabels attached to a
+// goroutine, keyed by that goroutine's ID. A goroutine's pprof labels
+// aren't part of its runtime.Stack text dump, so the leak reporter looks
+// them up here instead of trying to recover them from the stack trace.
+var goroutineLabels sync.Map // map[uint64]string
+
+// WithGoroutineLabels runs f, via runtime/pprof.Do, with the given
+// key/value pairs (kvs must alternate key, value, as with pprof.Labels)
+// attached as pprof labels, and records them so a leaked goroutine is
+// reported as e.g. "component=lease-ttl-loop" instead of an anonymous
+// stack trace that's indistinguishable from a dozen other etcd
+// subsystems. Typical use is to label a package's long-lived background
+// goroutine before starting it:
+//
+//	go testutil.WithGoroutineLabels(ctx, func(ctx context.Context) {
+//		le.runLoop(ctx)
+//	}, "component", "lease-ttl-loop")
+func WithGoroutineLabels(ctx context.Context, f func(context.Context), kvs ...string) {
+	pprof.Do(ctx, pprof.Labels(kvs...), func(ctx context.Context) {
+		if id, ok := currentGoroutineID(); ok {
+			goroutineLabels.Store(id, formatLabelPairs(kvs))
+			defer goroutineLabels.Delete(id)
+		}
+		f(ctx)
+	})
+}
+
+// currentGoroutineID returns the ID of the calling goroutine, parsed
+// from its own (single-goroutine) runtime.Stack dump.
+func currentGoroutineID() (uint64, bool) {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	return parseGoroutineID(string(buf))
+}
+
+// formatLabelPairs renders an alternating key, value slice as
+// "k1=v1, k2=v2", the form leak reports display labels in.
+func formatLabelPairs(kvs []string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kvs); i += 2 {
+		if b.Len() > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(kvs[i])
+		b.WriteByte('=')
+		b.WriteString(kvs[i+1])
+	}
+	return b.String()
+}
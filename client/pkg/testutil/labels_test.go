@@ -0,0 +1,104 @@
+// Copyright 2023 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFormatLabelPairs(t *testing.T) {
+	tests := []struct {
+		name string
+		kvs  []string
+		want string
+	}{
+		{name: "empty", kvs: nil, want: ""},
+		{name: "single pair", kvs: []string{"component", "mvcc"}, want: "component=mvcc"},
+		{
+			name: "multiple pairs",
+			kvs:  []string{"component", "lease-ttl-loop", "member", "X"},
+			want: "component=lease-ttl-loop, member=X",
+		},
+		{
+			name: "trailing odd key is dropped",
+			kvs:  []string{"component", "mvcc", "dangling"},
+			want: "component=mvcc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatLabelPairs(tt.kvs); got != tt.want {
+				t.Errorf("formatLabelPairs(%v) = %q, want %q", tt.kvs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithGoroutineLabelsRecordsAndClears(t *testing.T) {
+	var sawID uint64
+	var sawLabels string
+	done := make(chan struct{})
+	go WithGoroutineLabels(context.Background(), func(context.Context) {
+		defer close(done)
+		id, ok := currentGoroutineID()
+		if !ok {
+			t.Error("currentGoroutineID failed inside a labeled goroutine")
+			return
+		}
+		sawID = id
+		labels, ok := goroutineLabels.Load(id)
+		if !ok {
+			t.Error("expected goroutineLabels to hold an entry for the running goroutine")
+			return
+		}
+		sawLabels = labels.(string)
+	}, "component", "lease-ttl-loop")
+	<-done
+
+	if sawLabels != "component=lease-ttl-loop" {
+		t.Errorf("recorded labels = %q, want %q", sawLabels, "component=lease-ttl-loop")
+	}
+	if _, ok := goroutineLabels.Load(sawID); ok {
+		t.Errorf("expected goroutineLabels entry for goroutine %d to be cleared after WithGoroutineLabels returns", sawID)
+	}
+}
+
+func TestBuildLeakReportGroupsByStackAndLabels(t *testing.T) {
+	const stack = "main.f()\n\t/tmp/main.go:10 +0x1"
+	const header1 = "goroutine 1 [chan receive]:"
+	const header2 = "goroutine 2 [chan receive]:"
+
+	goroutineLabels.Store(uint64(1), "member=X")
+	goroutineLabels.Store(uint64(2), "member=Y")
+	defer goroutineLabels.Delete(uint64(1))
+	defer goroutineLabels.Delete(uint64(2))
+
+	dumps := []string{header1 + "\n" + stack, header2 + "\n" + stack}
+	report := buildLeakReport(dumps)
+
+	if len(report) != 2 {
+		t.Fatalf("buildLeakReport grouped %d entries, want 2 distinct labeled entries: %+v", len(report), report)
+	}
+	labels := map[string]bool{report[0].Labels: true, report[1].Labels: true}
+	if !labels["member=X"] || !labels["member=Y"] {
+		t.Errorf("expected one entry per label, got labels %v", labels)
+	}
+	for _, lg := range report {
+		if lg.Count != 1 {
+			t.Errorf("entry %+v: Count = %d, want 1", lg, lg.Count)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2023 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"testing"
+
+	"go.uber.org/goleak"
+)
+
+func TestNewLeakDetectorAppendsToDefaults(t *testing.T) {
+	want := len(defaultIgnoredGoroutines()) + 1
+	ld := NewLeakDetector(goleak.IgnoreTopFunction("main.extra"))
+	if got := len(ld.Options()); got != want {
+		t.Fatalf("NewLeakDetector(extra) kept %d options, want %d (etcd defaults plus extra)", got, want)
+	}
+}
+
+func TestLeakDetectorOptionsReturnsDefensiveCopy(t *testing.T) {
+	ld := NewLeakDetector()
+	before := len(ld.Options())
+
+	opts := ld.Options()
+	opts = append(opts, goleak.IgnoreTopFunction("main.extra"))
+
+	if got := len(ld.Options()); got != before {
+		t.Errorf("appending to a slice returned by Options mutated the detector: got %d options, want %d", got, before)
+	}
+}
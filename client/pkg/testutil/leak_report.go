@@ -0,0 +1,229 @@
+// Copyright 2023 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// goroutineHeaderFullRegexp splits a goroutine dump header line, e.g.
+// "goroutine 42 [chan receive, 3 minutes]:", into its ID and the
+// comma-separated contents of its brackets. The bracket contents are
+// parsed field-by-field below rather than with one fixed pattern,
+// because beyond the state they can carry an arbitrary, growing set of
+// suffixes the runtime adds — ", N minutes", ", locked to thread", and
+// potentially others in future Go versions.
+var goroutineHeaderFullRegexp = regexp.MustCompile(`^goroutine (\d+) \[(.+)\]:$`)
+
+// waitMinutesRegexp matches the "N minutes" bracket field.
+var waitMinutesRegexp = regexp.MustCompile(`^(\d+) minutes$`)
+
+// frameRegexp parses one stack frame: a "func(args)" line followed by a
+// "\tfile:line +0xNN" line, e.g.:
+//
+//	created by go.etcd.io/etcd/server/v3/etcdserver.(*EtcdServer).Start
+//		/go/src/go.etcd.io/etcd/server/v3/etcdserver/server.go:391 +0x1c5
+var frameRegexp = regexp.MustCompile(`(?m)^(.+)\n\t(.+):(\d+)(?: \+0x[0-9a-f]+)?$`)
+
+// Frame is a single parsed entry of a goroutine's stack trace.
+type Frame struct {
+	Func string `json:"func"`
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// LeakedGoroutine is one leaked goroutine, deduplicated against every
+// other currently running goroutine with the same normalized stack (see
+// normalizedRegexp) and the same Labels: Count is the number of such
+// instances. Labels is
+// populated from any testutil.WithGoroutineLabels annotation the
+// goroutine carried, turning "some grpc goroutine leaked" into "the
+// lease TTL loop for member X leaked".
+type LeakedGoroutine struct {
+	GoroutineID uint64  `json:"goroutine_id"`
+	State       string  `json:"state"`
+	WaitMinutes int     `json:"wait_minutes"`
+	Labels      string  `json:"labels,omitempty"`
+	Stack       []Frame `json:"stack"`
+	Count       int     `json:"count"`
+}
+
+// LeakReport is the structured, machine-readable counterpart to the
+// human text CheckLeakedGoroutine prints to stderr and CheckAfterTest
+// returns as an error, so CI
+// can ingest a leak failure from MustTestMainWithLeakDetection without
+// regex-scraping stderr.
+type LeakReport []LeakedGoroutine
+
+// buildLeakReport parses raw goroutine dumps, as returned by
+// interestingGoroutineDumps, into a LeakReport. Dumps that share both a
+// normalized stack and labels are grouped into a single entry, with Count set to
+// the number of instances and the other fields taken from the first one
+// seen.
+func buildLeakReport(dumps []string) LeakReport {
+	// Group by (normalized stack, labels), not stack alone: two goroutines
+	// running the same code path but labeled e.g. member=X vs member=Y
+	// must stay distinct entries, or the second member's identity is
+	// silently dropped behind a misleading Count: 2.
+	type key struct {
+		stack  string
+		labels string
+	}
+	type group struct {
+		entry LeakedGoroutine
+		count int
+	}
+	order := make([]key, 0, len(dumps))
+	groups := make(map[key]*group, len(dumps))
+	for _, dump := range dumps {
+		header, stack, ok := splitGoroutineDump(dump)
+		if !ok {
+			continue
+		}
+		entry := parseLeakedGoroutine(header, stack)
+		normalized := normalizedRegexp.ReplaceAllString(stack, "(...)")
+		k := key{stack: normalized, labels: entry.Labels}
+		g, seen := groups[k]
+		if !seen {
+			g = &group{entry: entry}
+			groups[k] = g
+			order = append(order, k)
+		}
+		g.count++
+	}
+
+	report := make(LeakReport, 0, len(order))
+	for _, k := range order {
+		g := groups[k]
+		g.entry.Count = g.count
+		report = append(report, g.entry)
+	}
+	return report
+}
+
+// parseLeakedGoroutine parses a goroutine's header line and stack trace
+// into a LeakedGoroutine. Count is left at zero; the caller fills it in.
+func parseLeakedGoroutine(header, stack string) LeakedGoroutine {
+	lg := LeakedGoroutine{Stack: parseFrames(stack)}
+	m := goroutineHeaderFullRegexp.FindStringSubmatch(header)
+	if m == nil {
+		return lg
+	}
+	lg.GoroutineID, _ = strconv.ParseUint(m[1], 10, 64)
+	fields := strings.Split(m[2], ", ")
+	lg.State = fields[0]
+	for _, field := range fields[1:] {
+		if wm := waitMinutesRegexp.FindStringSubmatch(field); wm != nil {
+			lg.WaitMinutes, _ = strconv.Atoi(wm[1])
+		}
+		// Other fields (e.g. "locked to thread") have no structured home
+		// yet; they're simply not dropped from matching the header.
+	}
+	if labels, ok := goroutineLabels.Load(lg.GoroutineID); ok {
+		lg.Labels = labels.(string)
+	}
+	return lg
+}
+
+func parseFrames(stack string) []Frame {
+	var frames []Frame
+	for _, m := range frameRegexp.FindAllStringSubmatch(stack, -1) {
+		line, err := strconv.Atoi(m[3])
+		if err != nil {
+			continue
+		}
+		frames = append(frames, Frame{Func: strings.TrimSpace(m[1]), File: m[2], Line: line})
+	}
+	return frames
+}
+
+// WriteJSON writes the report as a JSON array of LeakedGoroutine.
+func (r LeakReport) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+// junitTestsuite, junitTestcase and junitFailure cover just enough of the
+// JUnit XML schema for CI to list one failed test case per leaked
+// goroutine group.
+type junitTestsuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Testcases []junitTestcase `xml:"testcase"`
+}
+
+type junitTestcase struct {
+	Name    string        `xml:"name,attr"`
+	Failure *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the report as a JUnit XML testsuite, one testcase
+// per leaked goroutine group, so CI can surface leaks the same way it
+// surfaces test failures.
+func (r LeakReport) WriteJUnit(w io.Writer) error {
+	suite := junitTestsuite{
+		Name:     "testutil.LeakedGoroutines",
+		Tests:    len(r),
+		Failures: len(r),
+	}
+	for _, lg := range r {
+		frames := make([]string, 0, len(lg.Stack))
+		for _, f := range lg.Stack {
+			frames = append(frames, fmt.Sprintf("%s\n\t%s:%d", f.Func, f.File, f.Line))
+		}
+		name := fmt.Sprintf("goroutine %d [%s]", lg.GoroutineID, lg.State)
+		if lg.Labels != "" {
+			name = fmt.Sprintf("%s (%s)", name, lg.Labels)
+		}
+		suite.Testcases = append(suite.Testcases, junitTestcase{
+			Name: name,
+			Failure: &junitFailure{
+				Message: fmt.Sprintf("%d instance(s) leaked", lg.Count),
+				Text:    strings.Join(frames, "\n"),
+			},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(suite)
+}
+
+// writeLeakReportJSONFile writes report as JSON to path, creating or
+// truncating it.
+func writeLeakReportJSONFile(path string, report LeakReport) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return report.WriteJSON(f)
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestParseLeakedGoroutine(t *testing.T) {
+	tests := []struct {
+		name            string
+		header          string
+		wantID          uint64
+		wantState       string
+		wantWaitMinutes int
+	}{
+		{
+			name:      "running",
+			header:    "goroutine 42 [running]:",
+			wantID:    42,
+			wantState: "running",
+		},
+		{
+			name:            "chan receive with minutes",
+			header:          "goroutine 42 [chan receive, 3 minutes]:",
+			wantID:          42,
+			wantState:       "chan receive",
+			wantWaitMinutes: 3,
+		},
+		{
+			// Regression: cgo/resolver goroutines carry a "locked to
+			// thread" suffix instead of (or in addition to) a wait time.
+			name:      "syscall locked to thread",
+			header:    "goroutine 7 [syscall, locked to thread]:",
+			wantID:    7,
+			wantState: "syscall",
+		},
+		{
+			name:            "chan receive, minutes, and locked to thread",
+			header:          "goroutine 7 [chan receive, 10 minutes, locked to thread]:",
+			wantID:          7,
+			wantState:       "chan receive",
+			wantWaitMinutes: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stack := "created by main.start\n\t/tmp/main.go:10 +0x1c5"
+			lg := parseLeakedGoroutine(tt.header, stack)
+			if lg.GoroutineID != tt.wantID {
+				t.Errorf("GoroutineID = %d, want %d", lg.GoroutineID, tt.wantID)
+			}
+			if lg.State != tt.wantState {
+				t.Errorf("State = %q, want %q", lg.State, tt.wantState)
+			}
+			if lg.WaitMinutes != tt.wantWaitMinutes {
+				t.Errorf("WaitMinutes = %d, want %d", lg.WaitMinutes, tt.wantWaitMinutes)
+			}
+			if len(lg.Stack) != 1 || lg.Stack[0].Line != 10 {
+				t.Errorf("Stack = %+v, want a single frame at line 10", lg.Stack)
+			}
+		})
+	}
+}
+
+func TestLeakReportWriteJSON(t *testing.T) {
+	report := LeakReport{{
+		GoroutineID: 42,
+		State:       "chan receive",
+		WaitMinutes: 3,
+		Stack:       []Frame{{Func: "main.f", File: "/tmp/main.go", Line: 10}},
+		Count:       2,
+	}}
+
+	var buf bytes.Buffer
+	if err := report.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+
+	var decoded LeakReport
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("WriteJSON produced invalid JSON: %v", err)
+	}
+	if len(decoded) != 1 || decoded[0].GoroutineID != 42 || decoded[0].Count != 2 {
+		t.Errorf("decoded report = %+v, want one entry matching the input", decoded)
+	}
+}
+
+func TestLeakReportWriteJUnit(t *testing.T) {
+	report := LeakReport{{
+		GoroutineID: 42,
+		State:       "chan receive",
+		Stack:       []Frame{{Func: "main.f", File: "/tmp/main.go", Line: 10}},
+		Count:       1,
+	}}
+
+	var buf bytes.Buffer
+	if err := report.WriteJUnit(&buf); err != nil {
+		t.Fatalf("WriteJUnit: %v", err)
+	}
+
+	var suite junitTestsuite
+	if err := xml.Unmarshal(buf.Bytes(), &suite); err != nil {
+		t.Fatalf("WriteJUnit produced invalid XML: %v", err)
+	}
+	if suite.Tests != 1 || suite.Failures != 1 || len(suite.Testcases) != 1 {
+		t.Fatalf("suite = %+v, want one failing testcase", suite)
+	}
+	if !strings.Contains(suite.Testcases[0].Name, "goroutine 42") {
+		t.Errorf("testcase name = %q, want it to mention goroutine 42", suite.Testcases[0].Name)
+	}
+}